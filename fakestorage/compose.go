@@ -0,0 +1,217 @@
+// Copyright 2017 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/md5" // #nosec G501
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ComposeSource identifies one of the (at most 32) objects concatenated by
+// ComposeObject, optionally pinned to a specific generation of it.
+type ComposeSource struct {
+	Name       string
+	Generation int64
+}
+
+type composeRequest struct {
+	SourceObjects []struct {
+		Name       string `json:"name"`
+		Generation int64  `json:"generation,omitempty"`
+	} `json:"sourceObjects"`
+	Destination multipartMetadata `json:"destination"`
+}
+
+// composeObject handles POST /b/{bucketName}/o/{objectName}/compose,
+// concatenating up to 32 source objects into a single destination object.
+func (s *Server) composeObject(r *http.Request) jsonResponse {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	bucketName := vars["bucketName"]
+	destName := vars["objectName"]
+
+	if resp := s.checkUploadPreconditions(r, bucketName, destName); resp != nil {
+		return *resp
+	}
+
+	var req composeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+
+	sources := make([]ComposeSource, len(req.SourceObjects))
+	for i, src := range req.SourceObjects {
+		sources[i] = ComposeSource{Name: src.Name, Generation: src.Generation}
+	}
+
+	dest := Object{
+		BucketName:      bucketName,
+		Name:            destName,
+		ContentType:     req.Destination.ContentType,
+		ContentEncoding: req.Destination.ContentEncoding,
+		Metadata:        req.Destination.Metadata,
+		ACL:             getObjectACL(r.URL.Query().Get("destinationPredefinedAcl")),
+	}
+
+	obj, err := s.ComposeObject(dest, sources)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	return jsonResponse{data: obj}
+}
+
+// ComposeObject concatenates the content of sources, in the order given,
+// into dst and stores the result. The destination's CRC32C is recomputed
+// from each component's already-known CRC32C via CRC32 combination, so
+// components don't need to be rehashed; its MD5 is computed over the
+// concatenated content directly, and ComponentCount records the number of
+// sources.
+func (s *Server) ComposeObject(dst Object, sources []ComposeSource) (Object, error) {
+	if len(sources) == 0 {
+		return Object{}, errors.New("compose requires at least one source object")
+	}
+	if len(sources) > 32 {
+		return Object{}, errors.New("compose accepts at most 32 source objects")
+	}
+
+	upload := s.newUploadContents()
+	committed := false
+	defer func() {
+		if !committed {
+			upload.Close()
+		}
+	}()
+	md5sum := md5.New()
+	var crc uint32
+	var haveCRC bool
+
+	for _, src := range sources {
+		obj, err := s.GetObject(dst.BucketName, src.Name)
+		if err != nil {
+			return Object{}, fmt.Errorf("component %q: %w", src.Name, err)
+		}
+		if src.Generation != 0 && src.Generation != obj.Generation {
+			return Object{}, fmt.Errorf("component %q: generation %d not found", src.Name, src.Generation)
+		}
+		if !s.disableCSEKCheck && obj.CustomerEncryption != nil {
+			return Object{}, fmt.Errorf("component %q: can't compose an object encrypted with a customer-supplied encryption key", src.Name)
+		}
+
+		content := obj.contents()
+		r := io.NewSectionReader(content, 0, content.Size())
+		if _, err := io.Copy(io.MultiWriter(upload, md5sum), r); err != nil {
+			return Object{}, err
+		}
+
+		componentCRC, err := decodeCrc32c(obj.Crc32c)
+		if err != nil {
+			return Object{}, fmt.Errorf("component %q: %w", src.Name, err)
+		}
+		if !haveCRC {
+			crc = componentCRC
+			haveCRC = true
+		} else {
+			crc = crc32Combine(crc32.Castagnoli, crc, componentCRC, content.Size())
+		}
+	}
+
+	dst.setContents(upload.contents())
+	committed = true
+	dst.Crc32c = encodedChecksum(crc32cBytes(crc))
+	dst.Md5Hash = encodedHash(md5sum.Sum(nil))
+	dst.ComponentCount = len(sources)
+
+	return s.createObject(dst)
+}
+
+func decodeCrc32c(encoded string) (uint32, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return 0, err
+	}
+	if len(raw) != 4 {
+		return 0, errors.New("invalid crc32c checksum")
+	}
+	return binary.BigEndian.Uint32(raw), nil
+}
+
+func crc32cBytes(crc uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, crc)
+	return b
+}
+
+// gf2MatrixTimes multiplies the GF(2) matrix mat by the vector vec.
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+// gf2MatrixSquare squares the GF(2) matrix mat into square.
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
+
+// crc32Combine combines crc1 (the CRC32 of some block of bytes) and crc2
+// (the CRC32 of a second block of len2 bytes) into the CRC32 of the two
+// blocks concatenated, without re-reading either block. poly is the
+// reflected generator polynomial of the CRC variant in use (e.g.
+// crc32.Castagnoli). This is the well-known zlib crc32_combine algorithm.
+func crc32Combine(poly uint32, crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+
+	even := make([]uint32, 32)
+	odd := make([]uint32, 32)
+
+	// Operator for one zero bit.
+	odd[0] = poly
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+
+	gf2MatrixSquare(even, odd) // Operator for two zero bits.
+	gf2MatrixSquare(odd, even) // Operator for four zero bits.
+
+	result := crc1
+	for len2 > 0 {
+		gf2MatrixSquare(even, odd)
+		if len2&1 != 0 {
+			result = gf2MatrixTimes(even, result)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+
+		gf2MatrixSquare(odd, even)
+		if len2&1 != 0 {
+			result = gf2MatrixTimes(odd, result)
+		}
+		len2 >>= 1
+	}
+
+	return result ^ crc2
+}
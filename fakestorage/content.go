@@ -0,0 +1,181 @@
+// Copyright 2017 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto/md5" // #nosec G501
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// objectContents abstracts the backing store for an Object's bytes, so
+// small objects can stay in memory while large ones spool to disk without
+// handlers needing to care which is in play.
+type objectContents interface {
+	io.ReaderAt
+	io.Closer
+	Size() int64
+}
+
+// memoryContents keeps an object's bytes in a single in-memory buffer.
+type memoryContents struct {
+	data []byte
+}
+
+func newMemoryContents(data []byte) *memoryContents {
+	return &memoryContents{data: data}
+}
+
+func (c *memoryContents) Write(p []byte) (int, error) {
+	c.data = append(c.data, p...)
+	return len(p), nil
+}
+
+func (c *memoryContents) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(c.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, c.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *memoryContents) Size() int64  { return int64(len(c.data)) }
+func (c *memoryContents) Close() error { return nil }
+
+// fileContents spools an object's bytes to a file on disk, for objects
+// too large to comfortably hold in memory.
+type fileContents struct {
+	f *os.File
+}
+
+func newFileContents(spoolDir string) (*fileContents, error) {
+	f, err := ioutil.TempFile(spoolDir, "fake-gcs-object-")
+	if err != nil {
+		return nil, err
+	}
+	return &fileContents{f: f}, nil
+}
+
+func (c *fileContents) Write(p []byte) (int, error) { return c.f.Write(p) }
+
+func (c *fileContents) ReadAt(p []byte, off int64) (int, error) { return c.f.ReadAt(p, off) }
+
+func (c *fileContents) Size() int64 {
+	info, err := c.f.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (c *fileContents) Close() error {
+	name := c.f.Name()
+	err := c.f.Close()
+	os.Remove(name)
+	return err
+}
+
+// uploadContents buffers written data in memory until it crosses the
+// server's configured memory threshold (see WithObjectMemoryThreshold),
+// then transparently migrates to a fileContents under the server's spool
+// directory (see WithObjectSpoolDir). It lets upload handlers write
+// incrementally, in one shot or chunk-by-chunk, without knowing up front
+// whether the finished object will fit in memory.
+type uploadContents struct {
+	spoolDir        string
+	memoryThreshold int64
+	mem             *memoryContents
+	file            *fileContents
+}
+
+func (s *Server) newUploadContents() *uploadContents {
+	return &uploadContents{
+		spoolDir:        s.objectSpoolDir,
+		memoryThreshold: s.objectMemoryThreshold,
+		mem:             newMemoryContents(nil),
+	}
+}
+
+func (c *uploadContents) Write(p []byte) (int, error) {
+	if c.file != nil {
+		return c.file.Write(p)
+	}
+	if c.spoolDir != "" && int64(len(c.mem.data)+len(p)) > c.memoryThreshold {
+		file, err := newFileContents(c.spoolDir)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := file.Write(c.mem.data); err != nil {
+			file.Close()
+			return 0, err
+		}
+		c.file = file
+		c.mem = nil
+		return c.file.Write(p)
+	}
+	return c.mem.Write(p)
+}
+
+func (c *uploadContents) Size() int64 {
+	if c.file != nil {
+		return c.file.Size()
+	}
+	return c.mem.Size()
+}
+
+// contents returns the finished, read-only objectContents backing this
+// upload. It should only be called once no more data will be written.
+func (c *uploadContents) contents() objectContents {
+	if c.file != nil {
+		return c.file
+	}
+	return c.mem
+}
+
+// Close releases any resources (such as a spool file) held by an upload
+// that was abandoned before being committed to an object.
+func (c *uploadContents) Close() error {
+	if c.file != nil {
+		return c.file.Close()
+	}
+	return nil
+}
+
+// storeContent copies r into upload storage (in memory, or spooled to
+// disk once the server's memory threshold is crossed), computing CRC32C
+// and MD5 checksums incrementally via io.MultiWriter as the data is
+// copied, rather than hashing a fully-buffered byte slice afterwards.
+func (s *Server) storeContent(r io.Reader) (objectContents, string, string, error) {
+	upload := s.newUploadContents()
+	crc := crc32.New(crc32cTable)
+	md5sum := md5.New()
+	if _, err := io.Copy(io.MultiWriter(upload, crc, md5sum), r); err != nil {
+		upload.Close()
+		return nil, "", "", err
+	}
+	return upload.contents(), encodedChecksum(crc.Sum(make([]byte, 0, 4))), encodedHash(md5sum.Sum(nil)), nil
+}
+
+// checksumContent computes the CRC32C and MD5 checksums of an
+// objectContents by reading it back. It's used by paths, like resumable
+// uploads, that write chunks incrementally and only know the final
+// content once the upload is committed.
+func checksumContent(content objectContents) (string, string, error) {
+	crc := crc32.New(crc32cTable)
+	md5sum := md5.New()
+	r := io.NewSectionReader(content, 0, content.Size())
+	if _, err := io.Copy(io.MultiWriter(crc, md5sum), r); err != nil {
+		return "", "", err
+	}
+	return encodedChecksum(crc.Sum(make([]byte, 0, 4))), encodedHash(md5sum.Sum(nil)), nil
+}
@@ -7,37 +7,123 @@ package fakestorage
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 
+	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
 )
 
 // Object represents the object that is stored within the fake server.
 type Object struct {
-	BucketName string
-	Name       string
-	Content    []byte
+	BucketName      string
+	Name            string
+	Content         []byte
+	ContentType     string
+	ContentEncoding string
+	Crc32c          string
+	Md5Hash         string
+	ACL             []storage.ACLRule
+	Metadata        map[string]string
+
+	// Generation identifies a specific revision of the object's content, and
+	// Metageneration identifies a specific revision of the object's metadata.
+	// Both start at 1 and are incremented every time the respective data
+	// changes, mirroring how the real GCS JSON API versions objects.
+	Generation     int64
+	Metageneration int64
+
+	// ComponentCount records how many source objects were concatenated to
+	// produce this object's content; it's only set on objects created via
+	// ComposeObject.
+	ComponentCount int
+
+	// CustomerEncryption is set when the object was uploaded with a
+	// customer-supplied encryption key (CSEK), and causes reads to be
+	// rejected unless they present a key with a matching fingerprint. See
+	// WithCustomerEncryptionCheckDisabled to opt out.
+	CustomerEncryption *CustomerEncryption
+
+	// content backs Content when the object's bytes come from something
+	// other than a plain buffer, currently a file spooled to disk for
+	// large uploads (see content.go). It's unexported so the public API
+	// still just reads and writes Content; contents(), setContents() and
+	// closeContents() keep the two in sync.
+	content objectContents
 }
 
 func (o *Object) id() string {
 	return o.BucketName + "/" + o.Name
 }
 
+// contents returns the objectContents backing o's bytes: its spooled file,
+// if one was set via setContents, or a view over Content otherwise. This is
+// how package code reads an object's bytes without caring whether they live
+// in memory or on disk.
+func (o Object) contents() objectContents {
+	if o.content != nil {
+		return o.content
+	}
+	return newMemoryContents(o.Content)
+}
+
+// setContents records c as o's backing content. When c is a plain
+// in-memory buffer, its byte slice is stored in the exported Content field
+// so external callers (and anyone inspecting the struct directly) keep
+// seeing a normal []byte; spooled, disk-backed content is kept out of
+// Content and read back through contents() instead.
+func (o *Object) setContents(c objectContents) {
+	if mc, ok := c.(*memoryContents); ok {
+		o.Content = mc.data
+		o.content = nil
+		return
+	}
+	o.Content = nil
+	o.content = c
+}
+
+// closeContents releases any disk-backed content held by o, unlinking its
+// spool file. It's a no-op for objects whose content lives in Content.
+func (o *Object) closeContents() {
+	if o.content != nil {
+		o.content.Close()
+	}
+}
+
 // CreateObject stores the given object internally.
 //
 // If the bucket within the object doesn't exist, it also creates it. If the
 // object already exists, it overrides the object.
 func (s *Server) CreateObject(obj Object) {
+	s.createObject(obj)
+}
+
+// createObject stores the given object internally, assigning it a new
+// generation (and resetting its metageneration), and returns the stored
+// object. It behaves like CreateObject, but also reports errors and hands
+// back the object as actually persisted, which upload handlers need in
+// order to respond with the final generation number.
+func (s *Server) createObject(obj Object) (Object, error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 	index := s.findObject(obj)
+	if index < 0 {
+		obj.Generation = 1
+	} else {
+		obj.Generation = s.buckets[obj.BucketName][index].Generation + 1
+	}
+	obj.Metageneration = 1
 	if index < 0 {
 		s.buckets[obj.BucketName] = append(s.buckets[obj.BucketName], obj)
 	} else {
+		s.buckets[obj.BucketName][index].closeContents()
 		s.buckets[obj.BucketName][index] = obj
 	}
+	return obj, nil
 }
 
 // ListObjects returns a sorted list of objects that match the given criteria,
@@ -91,6 +177,65 @@ func (s *Server) findObject(obj Object) int {
 	return -1
 }
 
+// checkGenerationPreconditions verifies the ifGenerationMatch,
+// ifGenerationNotMatch, ifMetagenerationMatch and ifMetagenerationNotMatch
+// preconditions against obj. Preconditions are accepted both as query
+// string parameters (used by the JSON API) and as the
+// x-goog-generation-match/x-goog-metageneration-match headers (used by
+// signed URLs and other header-only clients). It returns a non-nil
+// jsonResponse when a precondition failed or a precondition value couldn't
+// be parsed as an integer.
+func checkGenerationPreconditions(r *http.Request, obj Object) *jsonResponse {
+	value := func(query, header string) string {
+		if v := r.URL.Query().Get(query); v != "" {
+			return v
+		}
+		return r.Header.Get(header)
+	}
+	preconditionFailed := &jsonResponse{status: http.StatusPreconditionFailed, errorMessage: "Precondition failed"}
+	badRequest := func(name string) *jsonResponse {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid " + name}
+	}
+
+	if v := value("ifGenerationMatch", "x-goog-generation-match"); v != "" {
+		generation, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return badRequest("ifGenerationMatch")
+		}
+		if generation != obj.Generation {
+			return preconditionFailed
+		}
+	}
+	if v := r.URL.Query().Get("ifGenerationNotMatch"); v != "" {
+		generation, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return badRequest("ifGenerationNotMatch")
+		}
+		if generation == obj.Generation {
+			return preconditionFailed
+		}
+	}
+	if v := value("ifMetagenerationMatch", "x-goog-metageneration-match"); v != "" {
+		metageneration, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return badRequest("ifMetagenerationMatch")
+		}
+		if metageneration != obj.Metageneration {
+			return preconditionFailed
+		}
+	}
+	if v := r.URL.Query().Get("ifMetagenerationNotMatch"); v != "" {
+		metageneration, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return badRequest("ifMetagenerationNotMatch")
+		}
+		if metageneration == obj.Metageneration {
+			return preconditionFailed
+		}
+	}
+	return nil
+}
+
 func (s *Server) listObjects(w http.ResponseWriter, r *http.Request) {
 	bucketName := mux.Vars(r)["bucketName"]
 	prefix := r.URL.Query().Get("prefix")
@@ -109,6 +254,13 @@ func (s *Server) listObjects(w http.ResponseWriter, r *http.Request) {
 func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	encoder := json.NewEncoder(w)
+	if r.URL.Query().Get("X-Goog-Algorithm") != "" {
+		if resp := s.verifySignedURL(r); resp != nil {
+			w.WriteHeader(resp.status)
+			encoder.Encode(newErrorResponse(resp.status, resp.errorMessage, nil))
+			return
+		}
+	}
 	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
 	if err != nil {
 		errResp := newErrorResponse(http.StatusNotFound, "Not Found", nil)
@@ -116,16 +268,101 @@ func (s *Server) getObject(w http.ResponseWriter, r *http.Request) {
 		encoder.Encode(errResp)
 		return
 	}
+	if resp := checkGenerationPreconditions(r, obj); resp != nil {
+		w.WriteHeader(resp.status)
+		encoder.Encode(newErrorResponse(resp.status, resp.errorMessage, nil))
+		return
+	}
+	if resp := s.checkCustomerEncryption(r, obj); resp != nil {
+		w.WriteHeader(resp.status)
+		encoder.Encode(newErrorResponse(resp.status, resp.errorMessage, nil))
+		return
+	}
 	encoder.Encode(newObjectResponse(obj, s))
 }
 
 func (s *Server) downloadObject(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
+	if r.URL.Query().Get("X-Goog-Algorithm") != "" {
+		if resp := s.verifySignedURL(r); resp != nil {
+			http.Error(w, resp.errorMessage, resp.status)
+			return
+		}
+	}
 	obj, err := s.GetObject(vars["bucketName"], vars["objectName"])
 	if err != nil {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(obj.Content)
+	if resp := checkGenerationPreconditions(r, obj); resp != nil {
+		http.Error(w, resp.errorMessage, resp.status)
+		return
+	}
+	if resp := s.checkCustomerEncryption(r, obj); resp != nil {
+		http.Error(w, resp.errorMessage, resp.status)
+		return
+	}
+
+	content := obj.contents()
+	size := content.Size()
+	if size == 0 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	start, end, status, ok := parseRangeHeader(r.Header.Get("Range"), size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if status == http.StatusPartialContent {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	w.WriteHeader(status)
+	io.Copy(w, io.NewSectionReader(content, start, end-start+1))
+}
+
+// parseRangeHeader parses a single-range HTTP Range header ("bytes=A-B",
+// "bytes=A-" or the suffix form "bytes=-N"), returning the inclusive byte
+// range to serve out of an object of the given size. A missing header
+// serves the whole object with a 200 response; an unsatisfiable range
+// reports ok=false so the caller can respond with 416.
+func parseRangeHeader(header string, size int64) (start, end int64, status int, ok bool) {
+	if header == "" {
+		return 0, size - 1, http.StatusOK, true
+	}
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, 0, false
+	}
+	rangeSpec := strings.SplitN(header[len(prefix):], ",", 2)[0]
+	parts := strings.SplitN(rangeSpec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, false
+	}
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, http.StatusPartialContent, true
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, 0, false
+	}
+	end = size - 1
+	if parts[1] != "" {
+		e, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || e < start {
+			return 0, 0, 0, false
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return start, end, http.StatusPartialContent, true
 }
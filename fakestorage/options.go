@@ -0,0 +1,58 @@
+// Copyright 2017 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import "time"
+
+// ServerOption configures optional behavior of a Server created with
+// NewServerWithOptions. Options are applied in the order they're passed,
+// and later options win if they touch the same setting.
+type ServerOption func(*Server) error
+
+// WithUploadTTL prunes resumable upload sessions that have seen no
+// activity for longer than ttl. A ttl of zero (the default) disables
+// pruning, so stale sessions accumulate in memory for the lifetime of the
+// server.
+func WithUploadTTL(ttl time.Duration) ServerOption {
+	return func(s *Server) error {
+		s.uploadTTL = ttl
+		return nil
+	}
+}
+
+// WithObjectSpoolDir sets the directory that object content spools to once
+// it grows past the configured memory threshold (see
+// WithObjectMemoryThreshold). An empty spool dir (the default) keeps every
+// object in memory, matching historical behavior.
+func WithObjectSpoolDir(dir string) ServerOption {
+	return func(s *Server) error {
+		s.objectSpoolDir = dir
+		return nil
+	}
+}
+
+// WithObjectMemoryThreshold sets how many bytes of object content are
+// buffered in memory; once an object grows past it, all of its content,
+// including what was buffered, moves to a file under the directory
+// configured with WithObjectSpoolDir. It has no effect unless a spool
+// directory is also set.
+func WithObjectMemoryThreshold(bytes int64) ServerOption {
+	return func(s *Server) error {
+		s.objectMemoryThreshold = bytes
+		return nil
+	}
+}
+
+// WithCustomerEncryptionCheckDisabled turns off the check that reads of
+// objects uploaded with a customer-supplied encryption key present an
+// x-goog-encryption-key with a matching fingerprint. Existing users who relied on reading
+// CSEK objects without presenting the key can use this to keep their
+// current behavior.
+func WithCustomerEncryptionCheckDisabled() ServerOption {
+	return func(s *Server) error {
+		s.disableCSEKCheck = true
+		return nil
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// RewriteOptions configures a RewriteObject call.
+//
+// A RewriteToken left empty starts a new rewrite, taking ContentType,
+// ContentEncoding, Metadata and PredefinedACL as overrides for the
+// destination (falling back to the source object's own values when left
+// unset); a non-empty RewriteToken resumes a rewrite previously left
+// incomplete because MaxBytesRewrittenPerCall was reached before the
+// whole object was copied, and the destination overrides (ContentType,
+// ContentEncoding, Metadata and PredefinedACL) are ignored;
+// MaxBytesRewrittenPerCall still applies to every call.
+type RewriteOptions struct {
+	PredefinedACL            string
+	ContentType              string
+	ContentEncoding          string
+	Metadata                 map[string]string
+	MaxBytesRewrittenPerCall int64
+	RewriteToken             string
+}
+
+// RewriteResponse reports the outcome of a (possibly partial) rewrite, as
+// returned by the JSON API's rewriteTo endpoint.
+type RewriteResponse struct {
+	Done                bool
+	ObjectSize          int64
+	TotalBytesRewritten int64
+	RewriteToken        string
+	Resource            Object
+}
+
+// rewriteState tracks an in-progress, resumable rewrite between calls to
+// RewriteObject, keyed by RewriteResponse.RewriteToken.
+type rewriteState struct {
+	srcBucket, srcObject string
+	dst                  Object
+	upload               *uploadContents
+	written              int64
+	total                int64
+}
+
+// rewriteObject handles POST
+// /b/{sourceBucket}/o/{sourceObject}/rewriteTo/b/{destinationBucket}/o/{destinationObject}.
+func (s *Server) rewriteObject(r *http.Request) jsonResponse {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+
+	opts := RewriteOptions{
+		PredefinedACL: r.URL.Query().Get("destinationPredefinedAcl"),
+		RewriteToken:  r.URL.Query().Get("rewriteToken"),
+	}
+	if v := r.URL.Query().Get("maxBytesRewrittenPerCall"); v != "" {
+		maxBytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid maxBytesRewrittenPerCall"}
+		}
+		opts.MaxBytesRewrittenPerCall = maxBytes
+	}
+
+	if opts.RewriteToken == "" {
+		if resp := s.checkUploadPreconditions(r, vars["destinationBucket"], vars["destinationObject"]); resp != nil {
+			return *resp
+		}
+		// The body, if present, carries destination metadata overrides; it's
+		// only meaningful on the call that starts the rewrite.
+		var overrides multipartMetadata
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil {
+				return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+			}
+		}
+		opts.ContentType = overrides.ContentType
+		opts.ContentEncoding = overrides.ContentEncoding
+		opts.Metadata = overrides.Metadata
+	}
+
+	resp, err := s.RewriteObject(vars["sourceBucket"], vars["sourceObject"], vars["destinationBucket"], vars["destinationObject"], opts)
+	if err != nil {
+		return jsonResponse{status: http.StatusNotFound, errorMessage: err.Error()}
+	}
+	return jsonResponse{data: resp}
+}
+
+// RewriteObject copies srcName from srcBucket into dstName in dstBucket,
+// applying any destination metadata overrides given in opts. It doesn't
+// check generation preconditions; the rewriteTo HTTP handler checks them
+// against the destination before starting a rewrite. When opts.MaxBytesRewrittenPerCall is set and smaller than the
+// source's size, RewriteObject copies only that many bytes and returns a
+// RewriteResponse with Done=false and a RewriteToken; calling it again
+// with that token (and the same source/destination) continues from where
+// it left off.
+func (s *Server) RewriteObject(srcBucket, srcName, dstBucket, dstName string, opts RewriteOptions) (RewriteResponse, error) {
+	var state *rewriteState
+
+	if opts.RewriteToken != "" {
+		raw, ok := s.rewrites.Load(opts.RewriteToken)
+		if !ok {
+			return RewriteResponse{}, errors.New("unknown rewriteToken")
+		}
+		state = raw.(*rewriteState)
+	} else {
+		src, err := s.GetObject(srcBucket, srcName)
+		if err != nil {
+			return RewriteResponse{}, err
+		}
+		if !s.disableCSEKCheck && src.CustomerEncryption != nil {
+			return RewriteResponse{}, errors.New("can't rewrite an object encrypted with a customer-supplied encryption key")
+		}
+
+		dst := Object{
+			BucketName:      dstBucket,
+			Name:            dstName,
+			ContentType:     firstNonEmpty(opts.ContentType, src.ContentType),
+			ContentEncoding: firstNonEmpty(opts.ContentEncoding, src.ContentEncoding),
+			Metadata:        src.Metadata,
+			ACL:             getObjectACL(opts.PredefinedACL),
+		}
+		if opts.Metadata != nil {
+			dst.Metadata = opts.Metadata
+		}
+
+		token, err := generateUploadID()
+		if err != nil {
+			return RewriteResponse{}, err
+		}
+		state = &rewriteState{
+			srcBucket: srcBucket,
+			srcObject: srcName,
+			dst:       dst,
+			upload:    s.newUploadContents(),
+			total:     src.contents().Size(),
+		}
+		opts.RewriteToken = token
+	}
+
+	src, err := s.GetObject(state.srcBucket, state.srcObject)
+	if err != nil {
+		s.rewrites.Delete(opts.RewriteToken)
+		state.upload.Close()
+		return RewriteResponse{}, err
+	}
+
+	toCopy := state.total - state.written
+	if opts.MaxBytesRewrittenPerCall > 0 && toCopy > opts.MaxBytesRewrittenPerCall {
+		toCopy = opts.MaxBytesRewrittenPerCall
+	}
+	if toCopy > 0 {
+		section := io.NewSectionReader(src.contents(), state.written, toCopy)
+		n, err := io.Copy(state.upload, section)
+		if err != nil {
+			s.rewrites.Delete(opts.RewriteToken)
+			state.upload.Close()
+			return RewriteResponse{}, err
+		}
+		state.written += n
+	}
+
+	if state.written < state.total {
+		s.rewrites.Store(opts.RewriteToken, state)
+		return RewriteResponse{
+			Done:                false,
+			ObjectSize:          state.total,
+			TotalBytesRewritten: state.written,
+			RewriteToken:        opts.RewriteToken,
+		}, nil
+	}
+
+	s.rewrites.Delete(opts.RewriteToken)
+	dst := state.dst
+	dst.setContents(state.upload.contents())
+	dst.Crc32c, dst.Md5Hash, err = checksumContent(dst.contents())
+	if err != nil {
+		dst.closeContents()
+		return RewriteResponse{}, err
+	}
+	obj, err := s.createObject(dst)
+	if err != nil {
+		dst.closeContents()
+		return RewriteResponse{}, err
+	}
+	return RewriteResponse{
+		Done:                true,
+		ObjectSize:          state.total,
+		TotalBytesRewritten: state.written,
+		Resource:            obj,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
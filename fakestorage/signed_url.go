@@ -0,0 +1,246 @@
+// Copyright 2017 Francisco Souza. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fakestorage
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signedURLKeys holds the keys registered via WithSignedURLHMACKey and
+// WithSignedURLRSAKey, indexed by credential id, plus the escape hatch for
+// test suites that don't want verification enforced.
+type signedURLKeys struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	disabled bool
+}
+
+// WithSignedURLHMACKey registers an HMAC-SHA256 key under credentialID so
+// that requests signed with GOOG4-HMAC-SHA256 can be verified.
+func WithSignedURLHMACKey(credentialID string, key []byte) ServerOption {
+	return func(s *Server) error {
+		if s.signedURLKeys.hmacKeys == nil {
+			s.signedURLKeys.hmacKeys = map[string][]byte{}
+		}
+		s.signedURLKeys.hmacKeys[credentialID] = key
+		return nil
+	}
+}
+
+// WithSignedURLRSAKey registers a PEM-encoded RSA public key under
+// credentialID so that requests signed with GOOG4-RSA-SHA256 can be
+// verified.
+func WithSignedURLRSAKey(credentialID string, publicKeyPEM []byte) ServerOption {
+	return func(s *Server) error {
+		block, _ := pem.Decode(publicKeyPEM)
+		if block == nil {
+			return errors.New("fakestorage: invalid PEM public key")
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("fakestorage: not an RSA public key")
+		}
+		if s.signedURLKeys.rsaKeys == nil {
+			s.signedURLKeys.rsaKeys = map[string]*rsa.PublicKey{}
+		}
+		s.signedURLKeys.rsaKeys[credentialID] = rsaPub
+		return nil
+	}
+}
+
+// WithSignedURLVerificationDisabled turns off V4 signature verification,
+// restoring the historical behavior of accepting any request that carries
+// an X-Goog-Algorithm parameter. Existing test suites that build signed
+// URLs without registering real keys can opt into this to keep passing.
+func WithSignedURLVerificationDisabled() ServerOption {
+	return func(s *Server) error {
+		s.signedURLKeys.disabled = true
+		return nil
+	}
+}
+
+// verifySignedURL validates the GOOG4-RSA-SHA256/GOOG4-HMAC-SHA256
+// signature, expiration and canonical request carried by a V4 signed URL,
+// as described at
+// https://cloud.google.com/storage/docs/access-control/signed-urls-v4.
+// It returns a non-nil response describing the failure when verification
+// doesn't pass.
+func (s *Server) verifySignedURL(r *http.Request) *jsonResponse {
+	if s.signedURLKeys.disabled {
+		return nil
+	}
+
+	q := r.URL.Query()
+	algorithm := q.Get("X-Goog-Algorithm")
+	credential := q.Get("X-Goog-Credential")
+	date := q.Get("X-Goog-Date")
+	expires := q.Get("X-Goog-Expires")
+	signedHeaders := q.Get("X-Goog-SignedHeaders")
+	signature := q.Get("X-Goog-Signature")
+	if algorithm == "" || credential == "" || date == "" || expires == "" || signedHeaders == "" || signature == "" {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "missing signed URL parameters"}
+	}
+
+	signedAt, err := time.Parse("20060102T150405Z", date)
+	if err != nil {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid X-Goog-Date"}
+	}
+	expiresIn, err := strconv.Atoi(expires)
+	if err != nil {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid X-Goog-Expires"}
+	}
+	if time.Now().After(signedAt.Add(time.Duration(expiresIn) * time.Second)) {
+		return &jsonResponse{status: http.StatusForbidden, errorMessage: "signature expired"}
+	}
+
+	credentialParts := strings.SplitN(credential, "/", 2)
+	if len(credentialParts) != 2 {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid X-Goog-Credential"}
+	}
+	credentialID, credentialScope := credentialParts[0], credentialParts[1]
+
+	canonicalRequest := canonicalRequestString(r, signedHeaders)
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("%s\n%s\n%s\n%s", algorithm, date, credentialScope, hex.EncodeToString(hashedRequest[:]))
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid X-Goog-Signature"}
+	}
+
+	switch algorithm {
+	case "GOOG4-HMAC-SHA256":
+		key, ok := s.signedURLKeys.hmacKeys[credentialID]
+		if !ok {
+			return &jsonResponse{status: http.StatusForbidden, errorMessage: "unknown credential"}
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(stringToSign))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return &jsonResponse{status: http.StatusForbidden, errorMessage: "signature mismatch"}
+		}
+	case "GOOG4-RSA-SHA256":
+		pub, ok := s.signedURLKeys.rsaKeys[credentialID]
+		if !ok {
+			return &jsonResponse{status: http.StatusForbidden, errorMessage: "unknown credential"}
+		}
+		digest := sha256.Sum256([]byte(stringToSign))
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return &jsonResponse{status: http.StatusForbidden, errorMessage: "signature mismatch"}
+		}
+	default:
+		return &jsonResponse{status: http.StatusBadRequest, errorMessage: "unsupported X-Goog-Algorithm"}
+	}
+
+	return nil
+}
+
+// canonicalRequestString assembles the canonical request used in a V4
+// string-to-sign: the HTTP method, canonical URI, canonical query string
+// (with X-Goog-Signature removed and the rest lexically sorted and
+// percent-encoded), the signed headers and their values, the signed
+// header list, and a payload hash placeholder. Uploads and downloads are
+// always signed with an unsigned payload.
+func canonicalRequestString(r *http.Request, signedHeaders string) string {
+	headerNames := strings.Split(signedHeaders, ";")
+
+	query := r.URL.Query()
+	query.Del("X-Goog-Signature")
+
+	var headerLines []string
+	for _, name := range headerNames {
+		canonicalName := strings.ToLower(name)
+		value := r.Header.Get(name)
+		if canonicalName == "host" && value == "" {
+			value = r.Host
+		}
+		headerLines = append(headerLines, canonicalName+":"+strings.TrimSpace(value))
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURIPath(r.URL.Path),
+		canonicalQueryString(query),
+		strings.Join(headerLines, "\n") + "\n",
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+}
+
+// canonicalURIPath percent-encodes path per RFC 3986, the form V4 signing
+// requires: unreserved characters pass through unescaped, "/" segment
+// separators are preserved, and everything else (including spaces, which
+// become "%20" rather than url.QueryEscape's "+") is escaped as %XX.
+func canonicalURIPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = rfc3986Escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQueryString renders query in the percent-encoded,
+// lexically-sorted-by-key form the V4 signing scheme requires.
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, rfc3986Escape(k)+"="+rfc3986Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// rfc3986Escape percent-encodes s per RFC 3986, leaving only the unreserved
+// characters (ALPHA / DIGIT / "-" / "." / "_" / "~") unescaped. This is
+// what V4 signing requires for both path segments and query keys/values;
+// unlike url.QueryEscape, a space becomes "%20" rather than "+".
+func rfc3986Escape(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isRFC3986Unreserved(c) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isRFC3986Unreserved(c byte) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	case c == '-' || c == '.' || c == '_' || c == '~':
+		return true
+	default:
+		return false
+	}
+}
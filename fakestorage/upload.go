@@ -5,7 +5,6 @@
 package fakestorage
 
 import (
-	"crypto/md5" // #nosec G501
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -18,6 +17,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/gorilla/mux"
@@ -78,20 +78,84 @@ func (s *Server) insertObject(r *http.Request) jsonResponse {
 	}
 }
 
+// checkUploadPreconditions verifies the ifGenerationMatch,
+// ifGenerationNotMatch, ifMetagenerationMatch and ifMetagenerationNotMatch
+// query parameters, as well as their x-goog-generation-match and
+// x-goog-metageneration-match header equivalents, against the current
+// generation/metageneration of the named object (if it exists).
 func (s *Server) checkUploadPreconditions(r *http.Request, bucketName string, objectName string) *jsonResponse {
-	ifGenerationMatch := r.URL.Query().Get("ifGenerationMatch")
+	obj, err := s.backend.GetObject(bucketName, objectName)
+	exists := err == nil
+	preconditionFailed := &jsonResponse{
+		status:       http.StatusPreconditionFailed,
+		errorMessage: "Precondition failed",
+	}
 
-	if ifGenerationMatch == "0" {
-		if _, err := s.backend.GetObject(bucketName, objectName); err == nil {
-			return &jsonResponse{
-				status:       http.StatusPreconditionFailed,
-				errorMessage: "Precondition failed",
+	if v := r.URL.Query().Get("ifGenerationMatch"); v != "" {
+		generation, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid ifGenerationMatch"}
+		}
+		if generation == 0 {
+			if exists {
+				return preconditionFailed
 			}
+		} else if !exists || generation != obj.Generation {
+			return preconditionFailed
+		}
+	}
+
+	if v := r.URL.Query().Get("ifGenerationNotMatch"); v != "" {
+		generation, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid ifGenerationNotMatch"}
+		}
+		if exists && generation == obj.Generation {
+			return preconditionFailed
+		}
+	}
+
+	if v := r.URL.Query().Get("ifMetagenerationMatch"); v != "" {
+		metageneration, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid ifMetagenerationMatch"}
+		}
+		if !exists || metageneration != obj.Metageneration {
+			return preconditionFailed
+		}
+	}
+
+	if v := r.URL.Query().Get("ifMetagenerationNotMatch"); v != "" {
+		metageneration, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid ifMetagenerationNotMatch"}
 		}
-	} else if ifGenerationMatch != "" || r.URL.Query().Get("ifGenerationNotMatch") != "" {
-		return &jsonResponse{
-			status:       http.StatusNotImplemented,
-			errorMessage: "Precondition support not implemented",
+		if exists && metageneration == obj.Metageneration {
+			return preconditionFailed
+		}
+	}
+
+	if v := r.Header.Get("x-goog-generation-match"); v != "" {
+		generation, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid x-goog-generation-match"}
+		}
+		if generation == 0 {
+			if exists {
+				return preconditionFailed
+			}
+		} else if !exists || generation != obj.Generation {
+			return preconditionFailed
+		}
+	}
+
+	if v := r.Header.Get("x-goog-metageneration-match"); v != "" {
+		metageneration, parseErr := strconv.ParseInt(v, 10, 64)
+		if parseErr != nil {
+			return &jsonResponse{status: http.StatusBadRequest, errorMessage: "invalid x-goog-metageneration-match"}
+		}
+		if !exists || metageneration != obj.Metageneration {
+			return preconditionFailed
 		}
 	}
 
@@ -109,20 +173,28 @@ func (s *Server) simpleUpload(bucketName string, r *http.Request) jsonResponse {
 			errorMessage: "name is required for simple uploads",
 		}
 	}
-	data, err := ioutil.ReadAll(r.Body)
+	if resp := s.checkUploadPreconditions(r, bucketName, name); resp != nil {
+		return *resp
+	}
+	customerEncryption, err := customerEncryptionFromHeaders(r)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+	content, crc32c, md5Hash, err := s.storeContent(r.Body)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
 	obj := Object{
-		BucketName:      bucketName,
-		Name:            name,
-		Content:         data,
-		ContentType:     r.Header.Get(contentTypeHeader),
-		ContentEncoding: contentEncoding,
-		Crc32c:          encodedCrc32cChecksum(data),
-		Md5Hash:         encodedMd5Hash(data),
-		ACL:             getObjectACL(predefinedACL),
-	}
+		BucketName:         bucketName,
+		Name:               name,
+		ContentType:        r.Header.Get(contentTypeHeader),
+		ContentEncoding:    contentEncoding,
+		Crc32c:             crc32c,
+		Md5Hash:            md5Hash,
+		ACL:                getObjectACL(predefinedACL),
+		CustomerEncryption: customerEncryption,
+	}
+	obj.setContents(content)
 	obj, err = s.createObject(obj)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
@@ -132,6 +204,9 @@ func (s *Server) simpleUpload(bucketName string, r *http.Request) jsonResponse {
 
 func (s *Server) signedUpload(bucketName string, r *http.Request) jsonResponse {
 	defer r.Body.Close()
+	if resp := s.verifySignedURL(r); resp != nil {
+		return *resp
+	}
 	name := mux.Vars(r)["objectName"]
 	predefinedACL := r.URL.Query().Get("predefinedAcl")
 	contentEncoding := r.URL.Query().Get("contentEncoding")
@@ -149,21 +224,30 @@ func (s *Server) signedUpload(bucketName string, r *http.Request) jsonResponse {
 		}
 	}
 
-	data, err := ioutil.ReadAll(r.Body)
+	if resp := s.checkUploadPreconditions(r, bucketName, name); resp != nil {
+		return *resp
+	}
+	customerEncryption, err := customerEncryptionFromHeaders(r)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
+
+	content, crc32c, md5Hash, err := s.storeContent(r.Body)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
 	obj := Object{
-		BucketName:      bucketName,
-		Name:            name,
-		Content:         data,
-		ContentType:     r.Header.Get(contentTypeHeader),
-		ContentEncoding: contentEncoding,
-		Crc32c:          encodedCrc32cChecksum(data),
-		Md5Hash:         encodedMd5Hash(data),
-		ACL:             getObjectACL(predefinedACL),
-		Metadata:        metaData,
-	}
+		BucketName:         bucketName,
+		Name:               name,
+		ContentType:        r.Header.Get(contentTypeHeader),
+		ContentEncoding:    contentEncoding,
+		Crc32c:             crc32c,
+		Md5Hash:            md5Hash,
+		ACL:                getObjectACL(predefinedACL),
+		Metadata:           metaData,
+		CustomerEncryption: customerEncryption,
+	}
+	obj.setContents(content)
 	obj, err = s.createObject(obj)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
@@ -191,35 +275,14 @@ func getObjectACL(predefinedACL string) []storage.ACLRule {
 
 var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
-func crc32cChecksum(content []byte) []byte {
-	checksummer := crc32.New(crc32cTable)
-	checksummer.Write(content)
-	return checksummer.Sum(make([]byte, 0, 4))
-}
-
 func encodedChecksum(checksum []byte) string {
 	return base64.StdEncoding.EncodeToString(checksum)
 }
 
-func encodedCrc32cChecksum(content []byte) string {
-	return encodedChecksum(crc32cChecksum(content))
-}
-
-func md5Hash(b []byte) []byte {
-	/* #nosec G401 */
-	h := md5.New()
-	h.Write(b)
-	return h.Sum(nil)
-}
-
 func encodedHash(hash []byte) string {
 	return base64.StdEncoding.EncodeToString(hash)
 }
 
-func encodedMd5Hash(content []byte) string {
-	return encodedHash(md5Hash(content))
-}
-
 func (s *Server) multipartUpload(bucketName string, r *http.Request) jsonResponse {
 	defer r.Body.Close()
 	_, params, err := mime.ParseMediaType(r.Header.Get(contentTypeHeader))
@@ -230,8 +293,9 @@ func (s *Server) multipartUpload(bucketName string, r *http.Request) jsonRespons
 		}
 	}
 	var (
-		metadata *multipartMetadata
-		content  []byte
+		metadata        *multipartMetadata
+		content         objectContents
+		crc32c, md5Hash string
 	)
 	var contentType string
 	reader := multipart.NewReader(r.Body, params["boundary"])
@@ -242,7 +306,7 @@ func (s *Server) multipartUpload(bucketName string, r *http.Request) jsonRespons
 			contentType = metadata.ContentType
 		} else {
 			contentType = part.Header.Get(contentTypeHeader)
-			content, err = loadContent(part)
+			content, crc32c, md5Hash, err = s.storeContent(part)
 		}
 		if err != nil {
 			break
@@ -261,18 +325,23 @@ func (s *Server) multipartUpload(bucketName string, r *http.Request) jsonRespons
 	if resp := s.checkUploadPreconditions(r, bucketName, objName); resp != nil {
 		return *resp
 	}
+	customerEncryption, err := customerEncryptionFromHeaders(r)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
 
 	obj := Object{
-		BucketName:      bucketName,
-		Name:            objName,
-		Content:         content,
-		ContentType:     contentType,
-		ContentEncoding: metadata.ContentEncoding,
-		Crc32c:          encodedCrc32cChecksum(content),
-		Md5Hash:         encodedMd5Hash(content),
-		ACL:             getObjectACL(predefinedACL),
-		Metadata:        metadata.Metadata,
-	}
+		BucketName:         bucketName,
+		Name:               objName,
+		ContentType:        contentType,
+		ContentEncoding:    metadata.ContentEncoding,
+		Crc32c:             crc32c,
+		Md5Hash:            md5Hash,
+		ACL:                getObjectACL(predefinedACL),
+		Metadata:           metadata.Metadata,
+		CustomerEncryption: customerEncryption,
+	}
+	obj.setContents(content)
 	obj, err = s.createObject(obj)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
@@ -291,18 +360,31 @@ func (s *Server) resumableUpload(bucketName string, r *http.Request) jsonRespons
 	if objName == "" {
 		objName = metadata.Name
 	}
+	if resp := s.checkUploadPreconditions(r, bucketName, objName); resp != nil {
+		return *resp
+	}
+	customerEncryption, err := customerEncryptionFromHeaders(r)
+	if err != nil {
+		return jsonResponse{status: http.StatusBadRequest, errorMessage: err.Error()}
+	}
 	obj := Object{
-		BucketName:      bucketName,
-		Name:            objName,
-		ContentEncoding: contentEncoding,
-		ACL:             getObjectACL(predefinedACL),
-		Metadata:        metadata.Metadata,
+		BucketName:         bucketName,
+		Name:               objName,
+		ContentEncoding:    contentEncoding,
+		ACL:                getObjectACL(predefinedACL),
+		Metadata:           metadata.Metadata,
+		CustomerEncryption: customerEncryption,
 	}
 	uploadID, err := generateUploadID()
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
-	s.uploads.Store(uploadID, obj)
+	s.pruneExpiredUploads()
+	s.uploads.Store(uploadID, &resumableUploadState{
+		object:       obj,
+		contents:     s.newUploadContents(),
+		lastActivity: time.Now(),
+	})
 	header := make(http.Header)
 	header.Set("Location", s.URL()+"/upload/resumable/"+uploadID)
 	if r.Header.Get("X-Goog-Upload-Command") == "start" {
@@ -350,41 +432,96 @@ func (s *Server) resumableUpload(bucketName string, r *http.Request) jsonRespons
 // it can't process a native "308 Permanent Redirect". The in-process response
 // then has a status of "200 OK", with a header "X-Http-Status-Code-Override"
 // set to "308".
+//
+// A client that wants to know how much of the upload has been received
+// without sending any data does so with a status-query request: a
+// "Content-Range: bytes */*" header (or any Content-Range header paired
+// with an empty body). That request, and any chunk that lies wholly within
+// or skips past what's already been stored, is answered without mutating
+// the upload so retries stay idempotent; a chunk that only partially
+// overlaps has just its new tail appended.
+//
+// Chunks are appended directly to the upload's backing store (in memory,
+// or a spool file once it grows past the server's memory threshold)
+// instead of reloading and re-copying everything received so far, so a
+// multi-gigabyte upload doesn't cost an ever-growing copy on every chunk.
 func (s *Server) uploadFileContent(r *http.Request) jsonResponse {
+	s.pruneExpiredUploads()
 	uploadID := mux.Vars(r)["uploadId"]
-	rawObj, ok := s.uploads.Load(uploadID)
+	rawUpload, ok := s.uploads.Load(uploadID)
 	if !ok {
 		return jsonResponse{status: http.StatusNotFound}
 	}
-	obj := rawObj.(Object)
+	upload := rawUpload.(*resumableUploadState)
+	upload.lastActivity = time.Now()
+	obj := upload.object
+	offset := upload.contents.Size()
+
+	contentRangeHeader := r.Header.Get("Content-Range")
+	if contentRangeHeader == "bytes */*" || (contentRangeHeader != "" && r.ContentLength == 0) {
+		return resumableUploadProgressResponse(r, offset, http.StatusPermanentRedirect)
+	}
+
+	var parsed contentRange
+	var err error
+	if contentRangeHeader != "" {
+		parsed, err = parseContentRange(contentRangeHeader)
+		if err != nil {
+			return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest}
+		}
+		if parsed.KnownRange {
+			switch {
+			case int64(parsed.Start) > offset:
+				// Gap: the client skipped bytes we never received.
+				return resumableUploadProgressResponse(r, offset, http.StatusServiceUnavailable)
+			case int64(parsed.End) < offset:
+				// Idempotent re-send of a chunk we've already committed.
+				return resumableUploadProgressResponse(r, offset, http.StatusPermanentRedirect)
+			}
+		}
+	}
+
 	content, err := loadContent(r.Body)
 	if err != nil {
 		return jsonResponse{errorMessage: err.Error()}
 	}
+	if parsed.KnownRange && int64(parsed.Start) < offset {
+		// Chunk partially overlaps what we already have; keep only the new
+		// tail. A re-sent chunk whose body is shorter than its declared
+		// range (or entirely covered already) has nothing new to add.
+		skip := offset - int64(parsed.Start)
+		if skip >= int64(len(content)) {
+			content = nil
+		} else {
+			content = content[skip:]
+		}
+	}
+	if _, err := upload.contents.Write(content); err != nil {
+		return jsonResponse{errorMessage: err.Error()}
+	}
+	obj.ContentType = r.Header.Get(contentTypeHeader)
+
 	commit := true
 	status := http.StatusOK
-	obj.Content = append(obj.Content, content...)
-	obj.Crc32c = encodedCrc32cChecksum(obj.Content)
-	obj.Md5Hash = encodedMd5Hash(obj.Content)
-	obj.ContentType = r.Header.Get(contentTypeHeader)
 	responseHeader := make(http.Header)
-	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
-		parsed, err := parseContentRange(contentRange)
-		if err != nil {
-			return jsonResponse{errorMessage: err.Error(), status: http.StatusBadRequest}
-		}
+	if contentRangeHeader != "" {
 		if parsed.KnownRange {
 			// Middle of streaming request, or any part of chunked request
 			responseHeader.Set("Range", fmt.Sprintf("bytes=0-%d", parsed.End))
 			// Complete if the range covers the known total
-			commit = parsed.KnownTotal && (parsed.End+1 >= parsed.Total)
-		} else {
+			commit = parsed.KnownTotal && (int64(parsed.End)+1 >= int64(parsed.Total))
+		} else if size := upload.contents.Size(); size > 0 {
 			// End of a streaming request
-			responseHeader.Set("Range", fmt.Sprintf("bytes=0-%d", len(obj.Content)))
+			responseHeader.Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
 		}
 	}
 	if commit {
 		s.uploads.Delete(uploadID)
+		obj.setContents(upload.contents.contents())
+		obj.Crc32c, obj.Md5Hash, err = checksumContent(obj.contents())
+		if err != nil {
+			return jsonResponse{errorMessage: err.Error()}
+		}
 		obj, err = s.createObject(obj)
 		if err != nil {
 			return jsonResponse{errorMessage: err.Error()}
@@ -397,7 +534,7 @@ func (s *Server) uploadFileContent(r *http.Request) jsonResponse {
 			// Python client
 			status = http.StatusPermanentRedirect
 		}
-		s.uploads.Store(uploadID, obj)
+		upload.object = obj
 	}
 	if r.Header.Get("X-Goog-Upload-Command") == "upload, finalize" {
 		responseHeader.Set("X-Goog-Upload-Status", "final")
@@ -409,6 +546,66 @@ func (s *Server) uploadFileContent(r *http.Request) jsonResponse {
 	}
 }
 
+// resumableUploadProgressResponse reports how many bytes of a resumable
+// upload have been received so far without mutating any state. It answers
+// status-query requests as well as chunk gaps and fully re-sent chunks,
+// all of which must leave the stored upload untouched.
+func resumableUploadProgressResponse(r *http.Request, offset int64, status int) jsonResponse {
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=0-%d", offset-1))
+	}
+	if status == http.StatusPermanentRedirect {
+		if _, no308 := r.Header["X-Guploader-No-308"]; no308 {
+			header.Set("X-Http-Status-Code-Override", "308")
+			return jsonResponse{status: http.StatusOK, header: header}
+		}
+	}
+	return jsonResponse{status: status, header: header}
+}
+
+// cancelResumableUpload handles a DELETE request against an in-progress
+// resumable upload session, discarding any data received so far.
+func (s *Server) cancelResumableUpload(r *http.Request) jsonResponse {
+	uploadID := mux.Vars(r)["uploadId"]
+	rawUpload, ok := s.uploads.Load(uploadID)
+	if !ok {
+		return jsonResponse{status: http.StatusNotFound}
+	}
+	rawUpload.(*resumableUploadState).contents.Close()
+	s.uploads.Delete(uploadID)
+	// 499 Client Closed Request: matches the status real GCS uses to
+	// acknowledge a cancelled resumable upload.
+	return jsonResponse{status: 499}
+}
+
+// resumableUploadState tracks an in-progress resumable upload together
+// with the last time a chunk for it was received, so idle sessions can be
+// pruned by pruneExpiredUploads (see WithUploadTTL).
+type resumableUploadState struct {
+	object       Object
+	contents     *uploadContents
+	lastActivity time.Time
+}
+
+// pruneExpiredUploads removes resumable upload sessions that have been
+// idle for longer than the configured upload TTL. It's a no-op when no
+// WithUploadTTL option was set.
+func (s *Server) pruneExpiredUploads() {
+	if s.uploadTTL <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-s.uploadTTL)
+	s.uploads.Range(func(key, value interface{}) bool {
+		upload := value.(*resumableUploadState)
+		if upload.lastActivity.Before(cutoff) {
+			upload.contents.Close()
+			s.uploads.Delete(key)
+		}
+		return true
+	})
+}
+
 // Parse a Content-Range header
 // Some possible valid header values:
 //   bytes 0-1023/4096 (first 1024 bytes of a 4096-byte document)